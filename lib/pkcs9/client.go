@@ -0,0 +1,334 @@
+/*
+ * Copyright (c) SAS Institute Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pkcs9
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"gerrit-pdt.unx.sas.com/tools/relic.git/lib/pkcs7"
+)
+
+const (
+	contentTypeTSQuery = "application/timestamp-query"
+	contentTypeTSReply = "application/timestamp-reply"
+
+	// nonceBytes is the size of the random nonce sent with each request.
+	nonceBytes = 16
+
+	defaultRetries = 3
+	defaultBackoff = 500 * time.Millisecond
+)
+
+// oidSHA{1,256,384,512} are the digest algorithm OIDs accepted in a
+// pkcs7.MessageImprint's HashAlgorithm field.
+var (
+	oidSHA1   = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+)
+
+// hashOID returns the digest algorithm identifier to use in a timestamp
+// request's MessageImprint for the given hash.
+func hashOID(hash crypto.Hash) pkix.AlgorithmIdentifier {
+	var oid asn1.ObjectIdentifier
+	switch hash {
+	case crypto.SHA1:
+		oid = oidSHA1
+	case crypto.SHA384:
+		oid = oidSHA384
+	case crypto.SHA512:
+		oid = oidSHA512
+	default:
+		oid = oidSHA256
+	}
+	return pkix.AlgorithmIdentifier{Algorithm: oid}
+}
+
+// TimeStampReq is the request structure defined in RFC 3161 section 2.4.1.
+// It reuses pkcs7.MessageImprint rather than declaring a parallel type,
+// since that's the same structure UnpackTokenInfo already parses out of a
+// TSTInfo when verifying a token.
+type TimeStampReq struct {
+	Version        int
+	MessageImprint pkcs7.MessageImprint
+	ReqPolicy      asn1.ObjectIdentifier `asn1:"optional"`
+	Nonce          *big.Int              `asn1:"optional"`
+	CertReq        bool                  `asn1:"optional"`
+	Extensions     []asn1.RawValue       `asn1:"optional,tag:0"`
+}
+
+// PKIStatusInfo is the status structure defined in RFC 3161 section 2.4.2.
+type PKIStatusInfo struct {
+	Status       int
+	StatusString []string       `asn1:"optional"`
+	FailInfo     asn1.BitString `asn1:"optional"`
+}
+
+// TimeStampResp is the response structure defined in RFC 3161 section 2.4.2.
+type TimeStampResp struct {
+	Status         PKIStatusInfo
+	TimeStampToken pkcs7.ContentInfoSignedData `asn1:"optional"`
+}
+
+// PKIStatus values from RFC 3161 section 2.4.2.
+const (
+	StatusGranted                = 0
+	StatusGrantedWithMods        = 1
+	StatusRejection              = 2
+	StatusWaiting                = 3
+	StatusRevocationWarning      = 4
+	StatusRevocationNotification = 5
+)
+
+// TimestampClient requests RFC 3161 timestamps from one or more TSA servers.
+// It retries across the configured URLs with exponential backoff, and
+// validates that the returned token's message imprint and nonce match what
+// was sent before handing it back to the caller.
+type TimestampClient struct {
+	// URLs is the ordered list of TSA endpoints to try. Entries may be
+	// http:// or https:// for the standard TSP-over-HTTP transport defined
+	// in RFC 3161 appendix A, or tcp:// for the legacy length-prefixed
+	// socket transport used by some older Windows-oriented TSAs.
+	URLs []string
+	// Hash is the digest algorithm used for the message imprint.
+	Hash crypto.Hash
+	// PolicyOID optionally requests a specific TSA policy. May be nil.
+	PolicyOID asn1.ObjectIdentifier
+	// Retries is the number of attempts made across all URLs before giving
+	// up. A single pass over URLs counts as one retry cycle. Zero means
+	// defaultRetries.
+	Retries int
+	// Backoff is the delay before the first retry; it doubles after each
+	// failed cycle. Zero means defaultBackoff.
+	Backoff time.Duration
+	// HTTPClient is used for http(s):// URLs. If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+	// DialTimeout bounds connection setup for the tcp:// transport. Zero
+	// means no explicit timeout beyond the context deadline.
+	DialTimeout time.Duration
+}
+
+// Timestamp requests a timestamp token over the given digest, which must
+// already be hashed using c.Hash. It tries each URL in turn, retrying the
+// whole list with exponential backoff, and returns the first token that
+// passes validation.
+func (c *TimestampClient) Timestamp(ctx context.Context, digest []byte) (*pkcs7.ContentInfoSignedData, error) {
+	if len(c.URLs) == 0 {
+		return nil, errors.New("pkcs9: no timestamp URLs configured")
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	req := TimeStampReq{
+		Version: 1,
+		MessageImprint: pkcs7.MessageImprint{
+			HashAlgorithm: hashOID(c.Hash),
+			HashedMessage: digest,
+		},
+		Nonce:   nonce,
+		CertReq: true,
+	}
+	if len(c.PolicyOID) > 0 {
+		req.ReqPolicy = c.PolicyOID
+	}
+	reqBytes, err := asn1.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("pkcs9: marshaling timestamp request: %w", err)
+	}
+
+	retries := c.Retries
+	if retries <= 0 {
+		retries = defaultRetries
+	}
+	backoff := c.Backoff
+	if backoff <= 0 {
+		backoff = defaultBackoff
+	}
+
+	var lastErr error
+	for attempt := 0; attempt < retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+		for _, url := range c.URLs {
+			token, err := c.requestOne(ctx, url, reqBytes)
+			if err != nil {
+				lastErr = fmt.Errorf("%s: %w", url, err)
+				continue
+			}
+			if err := c.verifyResponse(token, req); err != nil {
+				lastErr = fmt.Errorf("%s: %w", url, err)
+				continue
+			}
+			return token, nil
+		}
+	}
+	return nil, fmt.Errorf("pkcs9: all timestamp servers failed: %w", lastErr)
+}
+
+func (c *TimestampClient) requestOne(ctx context.Context, url string, reqBytes []byte) (*pkcs7.ContentInfoSignedData, error) {
+	switch {
+	case strings.HasPrefix(url, "http://"), strings.HasPrefix(url, "https://"):
+		return c.requestHTTP(ctx, url, reqBytes)
+	case strings.HasPrefix(url, "tcp://"):
+		return c.requestTCP(ctx, url, reqBytes)
+	default:
+		return nil, fmt.Errorf("pkcs9: unsupported timestamp URL scheme: %s", url)
+	}
+}
+
+func (c *TimestampClient) requestHTTP(ctx context.Context, url string, reqBytes []byte) (*pkcs7.ContentInfoSignedData, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(reqBytes))
+	if err != nil {
+		return nil, err
+	}
+	httpReq.Header.Set("Content-Type", contentTypeTSQuery)
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	httpResp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP status %s", httpResp.Status)
+	}
+	if ct := httpResp.Header.Get("Content-Type"); ct != "" && !strings.HasPrefix(ct, contentTypeTSReply) {
+		return nil, fmt.Errorf("unexpected content type %q", ct)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(httpResp.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	return parseResponse(body)
+}
+
+// requestTCP implements the legacy length-prefixed RFC 3161 transport used by
+// some older Windows-oriented TSAs: a 4-byte big-endian length header
+// followed by the DER-encoded request, with the response framed the same way.
+func (c *TimestampClient) requestTCP(ctx context.Context, url string, reqBytes []byte) (*pkcs7.ContentInfoSignedData, error) {
+	addr := strings.TrimPrefix(url, "tcp://")
+	dialer := net.Dialer{Timeout: c.DialTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], uint32(len(reqBytes)))
+	if _, err := conn.Write(header[:]); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(reqBytes); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, fmt.Errorf("reading response header: %w", err)
+	}
+	size := binary.BigEndian.Uint32(header[:])
+	if size == 0 || size > 1<<20 {
+		return nil, fmt.Errorf("implausible response size %d", size)
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("reading response body: %w", err)
+	}
+	return parseResponse(body)
+}
+
+func parseResponse(body []byte) (*pkcs7.ContentInfoSignedData, error) {
+	var resp TimeStampResp
+	if rest, err := asn1.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("parsing TimeStampResp: %w", err)
+	} else if len(rest) != 0 {
+		return nil, errors.New("trailing garbage after TimeStampResp")
+	}
+	if resp.Status.Status != StatusGranted && resp.Status.Status != StatusGrantedWithMods {
+		return nil, fmt.Errorf("TSA rejected request: status=%d %v", resp.Status.Status, resp.Status.StatusString)
+	}
+	return &resp.TimeStampToken, nil
+}
+
+// verifyResponse checks that the token's TSTInfo matches the request that
+// was sent: the same message imprint and, if one was sent, the same nonce.
+func (c *TimestampClient) verifyResponse(token *pkcs7.ContentInfoSignedData, req TimeStampReq) error {
+	if len(token.Content.SignerInfos) != 1 {
+		return errors.New("timestamp token should have exactly one SignerInfo")
+	}
+	if alg := token.Content.SignerInfos[0].DigestEncryptionAlgorithm.Algorithm; !IsSupportedTimestampSignatureAlgorithm(alg) {
+		return fmt.Errorf("TSA signed response with unsupported algorithm %s", alg)
+	}
+	info, err := UnpackTokenInfo(token)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(info.MessageImprint.HashedMessage, req.MessageImprint.HashedMessage) {
+		return errors.New("message imprint in response does not match request")
+	}
+	if req.Nonce != nil {
+		if info.Nonce == nil {
+			return errors.New("TSA response did not echo the nonce")
+		}
+		if info.Nonce.Cmp(req.Nonce) != 0 {
+			return errors.New("TSA response nonce does not match request")
+		}
+	}
+	return nil
+}
+
+// newNonce generates a random positive nonce for use in a TimeStampReq.
+func newNonce() (*big.Int, error) {
+	buf := make([]byte, nonceBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, fmt.Errorf("pkcs9: generating nonce: %w", err)
+	}
+	// Clear the top bit so the big-endian encoding is always treated as
+	// positive by asn1.Marshal.
+	buf[0] &= 0x7f
+	return new(big.Int).SetBytes(buf), nil
+}
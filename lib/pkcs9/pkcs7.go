@@ -104,6 +104,9 @@ func VerifyTimestamp(sig pkcs7.Signature) (*CounterSignature, error) {
 	} else {
 		return nil, err
 	}
+	if !IsSupportedTimestampSignatureAlgorithm(tsi.DigestEncryptionAlgorithm.Algorithm) {
+		return nil, fmt.Errorf("timestamp signed with unsupported algorithm %s", tsi.DigestEncryptionAlgorithm.Algorithm)
+	}
 	cert, err := tsi.Verify(verifyBlob, false, certs)
 	if err != nil {
 		return nil, err
@@ -140,8 +143,9 @@ func VerifyOptionalTimestamp(sig pkcs7.Signature) (TimestampedSignature, error)
 	}
 }
 
-// Verify that the timestamp token has a valid certificate chain
-func (cs CounterSignature) VerifyChain(roots *x509.CertPool, extraCerts []*x509.Certificate) error {
+// Verify that the timestamp token has a valid certificate chain. revoke may
+// be nil to skip revocation checking.
+func (cs CounterSignature) VerifyChain(roots *x509.CertPool, extraCerts []*x509.Certificate, revoke *RevocationOptions) error {
 	pool := x509.NewCertPool()
 	for _, cert := range extraCerts {
 		pool.AddCert(cert)
@@ -155,17 +159,102 @@ func (cs CounterSignature) VerifyChain(roots *x509.CertPool, extraCerts []*x509.
 		CurrentTime:   cs.SigningTime,
 		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
 	}
-	_, err := cs.Certificate.Verify(opts)
-	return err
+	chains, err := cs.Certificate.Verify(opts)
+	if err != nil {
+		return err
+	}
+	if revoke != nil {
+		if err := checkChainRevocation(chains[0], cs.stapledOCSP(), cs.SigningTime, revoke); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (sig TimestampedSignature) VerifyChain(roots *x509.CertPool, extraCerts []*x509.Certificate, usage x509.ExtKeyUsage) error {
+// stapledOCSP returns the DER-encoded OCSP response attached to the
+// timestamp's own SignerInfo, if the TSA included one, so that verification
+// can proceed offline.
+func (cs CounterSignature) stapledOCSP() []byte {
+	return stapledOCSPFrom(cs.SignerInfo)
+}
+
+// stapledOCSPFrom returns the DER-encoded OCSP response attached to info's
+// unauthenticated attributes, if any signer - the primary code-signing
+// signature or a TSA's own counter-signature - included one.
+func stapledOCSPFrom(info *pkcs7.SignerInfo) []byte {
+	if info == nil {
+		return nil
+	}
+	var der []byte
+	if err := info.UnauthenticatedAttributes.GetOne(OidAttributeStapledOCSPResponse, &der); err != nil {
+		return nil
+	}
+	return der
+}
+
+// checkChainRevocation checks every certificate in chain (other than the
+// root) for revocation as of at. stapled, if non-nil, is only applicable to
+// the leaf certificate; intermediates are always checked over the network
+// or cache.
+func checkChainRevocation(chain []*x509.Certificate, stapled []byte, at time.Time, revoke *RevocationOptions) error {
+	for i := 0; i+1 < len(chain); i++ {
+		cert, issuer := chain[i], chain[i+1]
+		var s []byte
+		if i == 0 {
+			s = stapled
+		}
+		if err := checkRevocation(cert, issuer, s, at, revoke); err != nil {
+			return fmt.Errorf("checking revocation of %s: %w", cert.Subject, err)
+		}
+	}
+	return nil
+}
+
+func (sig TimestampedSignature) VerifyChain(roots *x509.CertPool, extraCerts []*x509.Certificate, usage x509.ExtKeyUsage, revoke *RevocationOptions) error {
 	var signingTime time.Time
 	if sig.CounterSignature != nil {
-		if err := sig.CounterSignature.VerifyChain(roots, extraCerts); err != nil {
+		if err := sig.CounterSignature.VerifyChain(roots, extraCerts, revoke); err != nil {
 			return fmt.Errorf("validating timestamp: %s", err)
 		}
 		signingTime = sig.CounterSignature.SigningTime
 	}
-	return sig.Signature.VerifyChain(roots, extraCerts, usage, signingTime)
+	if err := sig.Signature.VerifyChain(roots, extraCerts, usage, signingTime); err != nil {
+		return err
+	}
+	if revoke != nil {
+		at := signingTime
+		if at.IsZero() {
+			at = time.Now()
+		}
+		if err := checkPrimaryChainRevocation(sig.Signature, roots, extraCerts, usage, at, revoke); err != nil {
+			return fmt.Errorf("validating signer: %w", err)
+		}
+	}
+	return nil
+}
+
+// checkPrimaryChainRevocation re-derives the primary code-signing
+// signature's own verified certificate chain and checks it for revocation,
+// the same way CounterSignature.VerifyChain already does for the TSA's
+// chain. sig.VerifyChain has already succeeded by the time this runs; the
+// re-verification here only recovers the chain that call doesn't return.
+func checkPrimaryChainRevocation(sig pkcs7.Signature, roots *x509.CertPool, extraCerts []*x509.Certificate, usage x509.ExtKeyUsage, at time.Time, revoke *RevocationOptions) error {
+	pool := x509.NewCertPool()
+	for _, cert := range extraCerts {
+		pool.AddCert(cert)
+	}
+	for _, cert := range sig.Intermediates {
+		pool.AddCert(cert)
+	}
+	opts := x509.VerifyOptions{
+		Intermediates: pool,
+		Roots:         roots,
+		CurrentTime:   at,
+		KeyUsages:     []x509.ExtKeyUsage{usage},
+	}
+	chains, err := sig.Certificate.Verify(opts)
+	if err != nil {
+		return err
+	}
+	return checkChainRevocation(chains[0], stapledOCSPFrom(sig.SignerInfo), at, revoke)
 }
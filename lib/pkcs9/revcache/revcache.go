@@ -0,0 +1,84 @@
+/*
+ * Copyright (c) SAS Institute Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package revcache provides a disk-backed pkcs9.RevocationCache so that
+// OCSP responses and CRLs fetched while verifying signatures survive
+// between process invocations, e.g. across repeated `relic verify` runs.
+package revcache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// DiskCache is a pkcs9.RevocationCache backed by a directory of files, one
+// per cache key. It is safe for concurrent use within a single process, but
+// does not lock against other processes sharing the same directory; a lost
+// race simply means a redundant fetch.
+type DiskCache struct {
+	Dir string
+}
+
+type entry struct {
+	Data      []byte    `json:"data"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// New returns a DiskCache rooted at dir, creating it if necessary.
+func New(dir string) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("revcache: creating cache directory: %w", err)
+	}
+	return &DiskCache{Dir: dir}, nil
+}
+
+func (c *DiskCache) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.Dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// Get implements pkcs9.RevocationCache.
+func (c *DiskCache) Get(key string) ([]byte, time.Time, bool) {
+	raw, err := ioutil.ReadFile(c.path(key))
+	if err != nil {
+		return nil, time.Time{}, false
+	}
+	var e entry
+	if err := json.Unmarshal(raw, &e); err != nil {
+		return nil, time.Time{}, false
+	}
+	if time.Now().After(e.ExpiresAt) {
+		return nil, time.Time{}, false
+	}
+	return e.Data, e.ExpiresAt, true
+}
+
+// Put implements pkcs9.RevocationCache.
+func (c *DiskCache) Put(key string, data []byte, expiresAt time.Time) {
+	raw, err := json.Marshal(entry{Data: data, ExpiresAt: expiresAt})
+	if err != nil {
+		return
+	}
+	// Best-effort: a failed write just means the next verification will
+	// re-fetch instead of reading from cache.
+	_ = ioutil.WriteFile(c.path(key), raw, 0o600)
+}
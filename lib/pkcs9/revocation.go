@@ -0,0 +1,309 @@
+/*
+ * Copyright (c) SAS Institute Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pkcs9
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// OidAttributeStapledOCSPResponse marks an unauthenticated SignerInfo
+// attribute carrying a DER-encoded OCSPResponse that the signer
+// obtained at signing time, so that verification can proceed offline
+// instead of needing to contact the responder.
+var OidAttributeStapledOCSPResponse = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 1}
+
+// RevocationCache stores OCSP responses and CRLs, keyed by the requester,
+// across verifications so that repeated calls to VerifyChain don't need to
+// re-fetch them. Entries should be discarded once they pass expiresAt.
+type RevocationCache interface {
+	Get(key string) (data []byte, expiresAt time.Time, ok bool)
+	Put(key string, data []byte, expiresAt time.Time)
+}
+
+// RevocationOptions controls revocation checking performed by VerifyChain.
+// A nil *RevocationOptions disables revocation checking entirely, preserving
+// the previous plain x509.Verify behavior.
+type RevocationOptions struct {
+	// Cache stores fetched OCSP responses and CRLs. If nil, a private
+	// in-memory cache is used for the lifetime of this RevocationOptions
+	// value.
+	Cache RevocationCache
+	// HTTPClient is used to fetch OCSP responses and CRLs. If nil,
+	// http.DefaultClient is used.
+	HTTPClient *http.Client
+	// HardFail, if true, causes VerifyChain to fail when a certificate's
+	// revocation status cannot be determined, e.g. no stapled response and
+	// both OCSP and CRL fetches fail. If false (the default, soft-fail),
+	// such certificates are treated as not revoked.
+	HardFail bool
+}
+
+func (o *RevocationOptions) cache() RevocationCache {
+	if o.Cache == nil {
+		o.Cache = NewMemoryCache()
+	}
+	return o.Cache
+}
+
+func (o *RevocationOptions) httpClient() *http.Client {
+	if o.HTTPClient == nil {
+		return http.DefaultClient
+	}
+	return o.HTTPClient
+}
+
+// MemoryCache is a process-lifetime RevocationCache backed by a map. It is
+// safe for concurrent use and is the default used when RevocationOptions.Cache
+// is left nil.
+type MemoryCache struct {
+	mu    sync.Mutex
+	items map[string]cacheItem
+}
+
+type cacheItem struct {
+	data      []byte
+	expiresAt time.Time
+}
+
+// NewMemoryCache returns an empty in-memory revocation cache.
+func NewMemoryCache() *MemoryCache {
+	return &MemoryCache{items: make(map[string]cacheItem)}
+}
+
+func (c *MemoryCache) Get(key string) ([]byte, time.Time, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	item, ok := c.items[key]
+	if !ok || time.Now().After(item.expiresAt) {
+		return nil, time.Time{}, false
+	}
+	return item.data, item.expiresAt, true
+}
+
+func (c *MemoryCache) Put(key string, data []byte, expiresAt time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.items[key] = cacheItem{data: data, expiresAt: expiresAt}
+}
+
+// RevokedError reports that a certificate's revocation status was
+// positively confirmed as revoked, by either a stapled OCSP response, a
+// freshly fetched OCSP response, or a CRL. Unlike every other error this
+// package returns from revocation checking, RevokedError is never swallowed
+// by RevocationOptions.HardFail == false: soft-fail only means "status
+// could not be determined," not "a confirmed revocation may be ignored."
+type RevokedError struct {
+	Cert   *x509.Certificate
+	At     time.Time
+	Reason string
+}
+
+func (e *RevokedError) Error() string {
+	return fmt.Sprintf("certificate %s was revoked at %s: %s", e.Cert.Subject, e.At, e.Reason)
+}
+
+// checkRevocation verifies that cert (issued by issuer) was not revoked as
+// of at. stapled, if non-nil, is a DER-encoded OCSPResponse taken
+// from the signature's unauthenticated attributes and is always preferred
+// over a network fetch. opts may be nil, in which case revocation is not
+// checked at all.
+func checkRevocation(cert, issuer *x509.Certificate, stapled []byte, at time.Time, opts *RevocationOptions) error {
+	if opts == nil {
+		return nil
+	}
+	if len(stapled) != 0 {
+		resp, err := ocsp.ParseResponseForCert(stapled, cert, issuer)
+		if err != nil {
+			return softFail(fmt.Errorf("parsing stapled OCSP response: %w", err), opts)
+		}
+		return softFail(evaluateOCSP(cert, resp, at), opts)
+	}
+
+	resp, ocspErr := fetchOCSP(cert, issuer, at, opts)
+	if ocspErr == nil {
+		return softFail(evaluateOCSP(cert, resp, at), opts)
+	}
+
+	// OCSP was unreachable; fall back to the CRL. A positive revocation
+	// finding from either check always wins, regardless of HardFail - only
+	// "status could not be determined" is soft-failable.
+	crlErr := checkCRL(cert, issuer, at, opts)
+	var revoked *RevokedError
+	if errors.As(crlErr, &revoked) {
+		return crlErr
+	}
+	if crlErr == nil {
+		return nil
+	}
+	return softFail(fmt.Errorf("checking revocation: OCSP: %s; CRL: %s", ocspErr, crlErr), opts)
+}
+
+// softFail applies RevocationOptions.HardFail's documented contract: a
+// confirmed *RevokedError is never swallowed, since soft-fail only means
+// "status could not be determined," but every other error - an expired or
+// unparseable response, an unreachable responder, an unrecognized OCSP
+// status - is returned only when HardFail is set, and otherwise treated as
+// not revoked.
+func softFail(err error, opts *RevocationOptions) error {
+	if err == nil {
+		return nil
+	}
+	var revoked *RevokedError
+	if errors.As(err, &revoked) {
+		return err
+	}
+	if opts.HardFail {
+		return err
+	}
+	return nil
+}
+
+func evaluateOCSP(cert *x509.Certificate, resp *ocsp.Response, at time.Time) error {
+	if !resp.NextUpdate.IsZero() && at.After(resp.NextUpdate) {
+		return errors.New("OCSP response has expired")
+	}
+	switch resp.Status {
+	case ocsp.Good:
+		return nil
+	case ocsp.Revoked:
+		if resp.RevokedAt.After(at) {
+			return nil
+		}
+		return &RevokedError{Cert: cert, At: resp.RevokedAt, Reason: fmt.Sprintf("reason code %d", resp.RevocationReason)}
+	default:
+		return errors.New("OCSP responder returned unknown status")
+	}
+}
+
+func fetchOCSP(cert, issuer *x509.Certificate, at time.Time, opts *RevocationOptions) (*ocsp.Response, error) {
+	if len(cert.OCSPServer) == 0 {
+		return nil, errors.New("certificate has no OCSP responder")
+	}
+	reqBytes, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+	cache := opts.cache()
+	key := "ocsp:" + string(cert.SerialNumber.Bytes())
+	var body []byte
+	if cached, _, ok := cache.Get(key); ok {
+		body = cached
+	} else {
+		var lastErr error
+		for _, url := range cert.OCSPServer {
+			httpResp, err := opts.httpClient().Post(url, "application/ocsp-request", bytes.NewReader(reqBytes))
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			data, err := ioutil.ReadAll(io.LimitReader(httpResp.Body, 1<<20))
+			httpResp.Body.Close()
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			if httpResp.StatusCode != http.StatusOK {
+				lastErr = fmt.Errorf("HTTP status %s", httpResp.Status)
+				continue
+			}
+			body = data
+			lastErr = nil
+			break
+		}
+		if body == nil {
+			if lastErr == nil {
+				lastErr = errors.New("no OCSP responders reachable")
+			}
+			return nil, lastErr
+		}
+	}
+	resp, err := ocsp.ParseResponseForCert(body, cert, issuer)
+	if err != nil {
+		return nil, err
+	}
+	expiresAt := resp.NextUpdate
+	if expiresAt.IsZero() {
+		expiresAt = at.Add(time.Hour)
+	}
+	cache.Put(key, body, expiresAt)
+	return resp, nil
+}
+
+func checkCRL(cert, issuer *x509.Certificate, at time.Time, opts *RevocationOptions) error {
+	if len(cert.CRLDistributionPoints) == 0 {
+		return errors.New("certificate has no CRL distribution points and no reachable OCSP responder")
+	}
+	cache := opts.cache()
+	key := "crl:" + issuer.Subject.String()
+	var der []byte
+	if cached, _, ok := cache.Get(key); ok {
+		der = cached
+	} else {
+		var lastErr error
+		for _, url := range cert.CRLDistributionPoints {
+			httpResp, err := opts.httpClient().Get(url)
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			data, err := ioutil.ReadAll(io.LimitReader(httpResp.Body, 16<<20))
+			httpResp.Body.Close()
+			if err != nil {
+				lastErr = err
+				continue
+			}
+			if httpResp.StatusCode != http.StatusOK {
+				lastErr = fmt.Errorf("HTTP status %s", httpResp.Status)
+				continue
+			}
+			der = data
+			lastErr = nil
+			break
+		}
+		if der == nil {
+			if lastErr == nil {
+				lastErr = errors.New("no CRL distribution points reachable")
+			}
+			return lastErr
+		}
+	}
+	list, err := x509.ParseCRL(der)
+	if err != nil {
+		return fmt.Errorf("parsing CRL: %w", err)
+	}
+	if err := issuer.CheckCRLSignature(list); err != nil {
+		return fmt.Errorf("invalid CRL signature: %w", err)
+	}
+	cache.Put(key, der, list.TBSCertList.NextUpdate)
+	for _, entry := range list.TBSCertList.RevokedCertificates {
+		if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 && !entry.RevocationTime.After(at) {
+			return &RevokedError{Cert: cert, At: entry.RevocationTime, Reason: "present in CRL"}
+		}
+	}
+	return nil
+}
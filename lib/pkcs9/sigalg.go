@@ -0,0 +1,92 @@
+/*
+ * Copyright (c) SAS Institute Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package pkcs9
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"encoding/asn1"
+)
+
+// Signature algorithm OIDs for ECDSA over the NIST curves and Ed25519,
+// accepted by IsSupportedTimestampSignatureAlgorithm when checking a TSA's
+// timestamp token: some modern TSAs sign with these instead of RSA.
+var (
+	OidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	OidECDSAWithSHA384 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}
+	OidECDSAWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}
+	OidEd25519         = asn1.ObjectIdentifier{1, 3, 101, 112}
+)
+
+// HashForKey returns the digest algorithm that must be used in a timestamp
+// request's MessageImprint, and in the CMS digestAlgorithm of the resulting
+// signature, for the given signing key. ok is false for keys that have no
+// such constraint (e.g. RSA), where the caller's configured default applies.
+//
+// The NIST curves are paired with their conventional hash per SEC1/FIPS
+// 186-4 (P-256/SHA-256, P-384/SHA-384, P-521/SHA-512); Ed25519 always pairs
+// with SHA-512, per RFC 8419, since the Ed25519 algorithm itself does not
+// take a pre-hashed digest.
+func HashForKey(pub crypto.PublicKey) (hash crypto.Hash, ok bool) {
+	switch key := pub.(type) {
+	case *ecdsa.PublicKey:
+		switch key.Curve {
+		case elliptic.P256():
+			return crypto.SHA256, true
+		case elliptic.P384():
+			return crypto.SHA384, true
+		case elliptic.P521():
+			return crypto.SHA512, true
+		default:
+			return 0, false
+		}
+	case ed25519.PublicKey:
+		return crypto.SHA512, true
+	default:
+		return 0, false
+	}
+}
+
+// rsaSignatureOIDs are the RSA signature algorithm OIDs VerifyTimestamp has
+// always accepted from a TSA, alongside the ECDSA/Ed25519 OIDs above.
+var rsaSignatureOIDs = []asn1.ObjectIdentifier{
+	{1, 2, 840, 113549, 1, 1, 1},  // rsaEncryption
+	{1, 2, 840, 113549, 1, 1, 5},  // sha1WithRSAEncryption
+	{1, 2, 840, 113549, 1, 1, 11}, // sha256WithRSAEncryption
+	{1, 2, 840, 113549, 1, 1, 12}, // sha384WithRSAEncryption
+	{1, 2, 840, 113549, 1, 1, 13}, // sha512WithRSAEncryption
+}
+
+// IsSupportedTimestampSignatureAlgorithm reports whether oid, the signature
+// algorithm a TSA used over a timestamp token, is one VerifyTimestamp is
+// willing to accept: RSA, or one of the ECDSA/Ed25519 algorithms this
+// package added support for. VerifyTimestamp rejects anything else outright
+// rather than silently deferring to whatever pkcs7.SignerInfo.Verify
+// happens to implement.
+func IsSupportedTimestampSignatureAlgorithm(oid asn1.ObjectIdentifier) bool {
+	if oid.Equal(OidECDSAWithSHA256) || oid.Equal(OidECDSAWithSHA384) || oid.Equal(OidECDSAWithSHA512) || oid.Equal(OidEd25519) {
+		return true
+	}
+	for _, rsaOID := range rsaSignatureOIDs {
+		if oid.Equal(rsaOID) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,196 @@
+/*
+ * Copyright (c) SAS Institute Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package signers
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"gerrit-pdt.unx.sas.com/tools/relic.git/lib/pkcs7"
+	"gerrit-pdt.unx.sas.com/tools/relic.git/lib/pkcs9"
+)
+
+// Bundle is a self-contained, out-of-band representation of a signature: the
+// detached PKCS#7 SignerInfo, its RFC 3161 timestamp token (if any), the
+// full certificate chain including any intermediates recovered from the
+// timestamp response, and a little metadata about what was signed. A bundle
+// can be stored and transported separately from the artifact it covers, and
+// re-verified later against a trust store with Bundle.Verify, without
+// needing the artifact's own embedded signature.
+type Bundle struct {
+	// Digest is the digest of the original file that was signed.
+	Digest []byte `json:"digest"`
+	// Hash names the digest algorithm used for Digest, e.g. "SHA-256".
+	Hash string `json:"hash"`
+	// SignerInfo is the DER encoding of the detached PKCS#7 SignerInfo.
+	SignerInfo []byte `json:"signer_info"`
+	// Timestamp is the DER encoding of the RFC 3161 timestamp token
+	// attached to SignerInfo, if any.
+	Timestamp []byte `json:"timestamp,omitempty"`
+	// Certificates holds the DER encoding of the X.509 chain, leaf first,
+	// including any intermediates recovered from the timestamp response.
+	Certificates [][]byte `json:"certificates"`
+	// Identity is a human-readable description of the signer, normally the
+	// leaf certificate's subject common name.
+	Identity string `json:"identity,omitempty"`
+	// SigningTime is the time the signature's timestamp claims to have
+	// been made. It is zero if the signature was never timestamped.
+	SigningTime time.Time `json:"signing_time,omitempty"`
+}
+
+// NewBundleFromSignedData builds a Bundle from a completed PKCS#7
+// ContentInfoSignedData blob, such as the one returned by pkcs.Timestamp.
+// digest and hashName describe the original file digest that was signed.
+func NewBundleFromSignedData(blob, digest []byte, hashName string) (*Bundle, error) {
+	var sd pkcs7.ContentInfoSignedData
+	if _, err := asn1.Unmarshal(blob, &sd); err != nil {
+		return nil, fmt.Errorf("signers: parsing signed data for bundle: %w", err)
+	}
+	if len(sd.Content.SignerInfos) != 1 {
+		return nil, errors.New("signers: expected exactly one SignerInfo")
+	}
+	signerInfo := sd.Content.SignerInfos[0]
+	certs, err := sd.Content.Certificates.Parse()
+	if err != nil {
+		return nil, fmt.Errorf("signers: parsing certificates for bundle: %w", err)
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("signers: signed data has no certificates")
+	}
+
+	infoDER, err := asn1.Marshal(signerInfo)
+	if err != nil {
+		return nil, fmt.Errorf("signers: marshaling signer info for bundle: %w", err)
+	}
+	b := &Bundle{
+		Digest:     digest,
+		Hash:       hashName,
+		SignerInfo: infoDER,
+		Identity:   certs[0].Subject.CommonName,
+	}
+	for _, cert := range certs {
+		b.Certificates = append(b.Certificates, cert.Raw)
+	}
+
+	sig := pkcs7.Signature{SignerInfo: &signerInfo, Certificate: certs[0], Intermediates: certs[1:]}
+	tsig, err := pkcs9.VerifyOptionalTimestamp(sig)
+	if err != nil {
+		return nil, fmt.Errorf("signers: verifying timestamp for bundle: %w", err)
+	}
+	if tsig.CounterSignature != nil {
+		b.SigningTime = tsig.CounterSignature.SigningTime
+		tokenDER, err := ExtractTimestampToken(&signerInfo)
+		if err != nil {
+			return nil, fmt.Errorf("signers: re-reading timestamp token for bundle: %w", err)
+		}
+		b.Timestamp = tokenDER
+		seen := make(map[string]bool, len(b.Certificates))
+		for _, der := range b.Certificates {
+			seen[string(der)] = true
+		}
+		for _, cert := range tsig.CounterSignature.Intermediates {
+			if !seen[string(cert.Raw)] {
+				seen[string(cert.Raw)] = true
+				b.Certificates = append(b.Certificates, cert.Raw)
+			}
+		}
+	}
+	return b, nil
+}
+
+// ExtractTimestampToken returns the DER encoding of the RFC 3161 timestamp
+// token attached to signerInfo's unauthenticated attributes, if any. It
+// returns pkcs7.ErrNoAttribute if signerInfo was never timestamped.
+func ExtractTimestampToken(signerInfo *pkcs7.SignerInfo) ([]byte, error) {
+	var tst pkcs7.ContentInfoSignedData
+	err := signerInfo.UnauthenticatedAttributes.GetOne(pkcs9.OidAttributeTimeStampToken, &tst)
+	if _, ok := err.(pkcs7.ErrNoAttribute); ok {
+		err = signerInfo.UnauthenticatedAttributes.GetOne(pkcs9.OidSpcTimeStampToken, &tst)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(tst)
+}
+
+// Write serializes the bundle as JSON.
+func (b *Bundle) Write(w io.Writer) error {
+	return json.NewEncoder(w).Encode(b)
+}
+
+// ReadBundle deserializes a bundle previously written by Bundle.Write.
+func ReadBundle(r io.Reader) (*Bundle, error) {
+	var b Bundle
+	if err := json.NewDecoder(r).Decode(&b); err != nil {
+		return nil, fmt.Errorf("signers: decoding bundle: %w", err)
+	}
+	return &b, nil
+}
+
+// Verify parses the bundle's embedded signer info, certificate chain and
+// timestamp, checks the chain against roots, and returns the reconstructed
+// signature on success. revoke may be nil to skip revocation checking.
+// Otherwise a stapled OCSP response on the timestamp's or the signer's
+// SignerInfo is used for that chain's leaf certificate in place of a network
+// fetch; intermediates are always checked via the network or the revocation
+// cache. It does not require access to the
+// original signed artifact; callers that need to confirm the artifact
+// itself matches the bundle should separately compare its digest against
+// b.Digest.
+func (b *Bundle) Verify(roots *x509.CertPool, usage x509.ExtKeyUsage, revoke *pkcs9.RevocationOptions) (*pkcs9.TimestampedSignature, error) {
+	if len(b.Certificates) == 0 {
+		return nil, errors.New("signers: bundle has no certificates")
+	}
+	certs := make([]*x509.Certificate, len(b.Certificates))
+	for i, der := range b.Certificates {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("signers: parsing bundle certificate %d: %w", i, err)
+		}
+		certs[i] = cert
+	}
+	var signerInfo pkcs7.SignerInfo
+	if _, err := asn1.Unmarshal(b.SignerInfo, &signerInfo); err != nil {
+		return nil, fmt.Errorf("signers: parsing bundle signer info: %w", err)
+	}
+	sig := pkcs7.Signature{SignerInfo: &signerInfo, Certificate: certs[0], Intermediates: certs[1:]}
+
+	tsig := pkcs9.TimestampedSignature{Signature: sig}
+	if len(b.Timestamp) != 0 {
+		var token pkcs7.ContentInfoSignedData
+		if _, err := asn1.Unmarshal(b.Timestamp, &token); err != nil {
+			return nil, fmt.Errorf("signers: parsing bundle timestamp: %w", err)
+		}
+		if err := pkcs9.AddStampToSignedData(sig.SignerInfo, token); err != nil {
+			return nil, err
+		}
+		cs, err := pkcs9.VerifyTimestamp(sig)
+		if err != nil {
+			return nil, fmt.Errorf("signers: verifying bundle timestamp: %w", err)
+		}
+		tsig.CounterSignature = cs
+	}
+	if err := tsig.VerifyChain(roots, nil, usage, revoke); err != nil {
+		return nil, err
+	}
+	return &tsig, nil
+}
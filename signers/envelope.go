@@ -0,0 +1,394 @@
+/*
+ * Copyright (c) SAS Institute Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package signers
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"gerrit-pdt.unx.sas.com/tools/relic.git/lib/authenticode"
+	"gerrit-pdt.unx.sas.com/tools/relic.git/lib/pkcs7"
+	"gerrit-pdt.unx.sas.com/tools/relic.git/lib/pkcs9"
+	"gerrit-pdt.unx.sas.com/tools/relic.git/lib/x509tools"
+)
+
+// SignatureManifest is a JWS-style JSON envelope that carries the same file
+// digest, signer certificate chain, and timestamp token as a PKCS#7
+// signature, for systems that don't parse PKCS#7 natively (CI/CD, artifact
+// registries, SBOM attachments). Unlike an embedded PKCS#7 signature, a
+// manifest can carry several parallel signatures over the same payload, e.g.
+// a developer signature alongside a release-engineering countersignature.
+type SignatureManifest struct {
+	// Payload is the base64url (no padding) encoding of the JSON-encoded
+	// envelopePayload describing what was signed.
+	Payload string `json:"payload"`
+	// Signatures holds one entry per independent signer.
+	Signatures []EnvelopeSignature `json:"signatures"`
+}
+
+// EnvelopeSignature is a single signature over a SignatureManifest's
+// payload, JWS-style: it signs `protected + "." + payload`.
+type EnvelopeSignature struct {
+	// Protected is the base64url encoding of the JSON-encoded
+	// envelopeHeader describing this signature.
+	Protected string `json:"protected"`
+	// Signature is the base64url encoding of the raw signature bytes.
+	Signature string `json:"signature"`
+}
+
+// envelopePayload is the JSON structure embedded (base64url-encoded) in
+// SignatureManifest.Payload. Digest is itself base64url (no padding)
+// encoded, like every other binary field in the envelope, so that a
+// consumer only needs one decoder.
+type envelopePayload struct {
+	Hash   string `json:"hash"`
+	Digest string `json:"digest"`
+}
+
+// envelopeHeader is the JSON structure embedded (base64url-encoded) in each
+// EnvelopeSignature.Protected. Certificates and Timestamp are base64url (no
+// padding) encoded, matching Digest above.
+type envelopeHeader struct {
+	Alg          string   `json:"alg"`
+	Certificates []string `json:"x5c"`
+	Timestamp    string   `json:"timestamp,omitempty"`
+	Identity     string   `json:"identity,omitempty"`
+}
+
+// NewSignatureManifest starts a manifest describing a file with the given
+// digest. Use AddSignature to attach one or more signatures over it.
+func NewSignatureManifest(digest []byte, hash crypto.Hash) (*SignatureManifest, error) {
+	payload, err := json.Marshal(envelopePayload{Hash: hash.String(), Digest: base64.RawURLEncoding.EncodeToString(digest)})
+	if err != nil {
+		return nil, fmt.Errorf("signers: marshaling envelope payload: %w", err)
+	}
+	return &SignatureManifest{Payload: base64.RawURLEncoding.EncodeToString(payload)}, nil
+}
+
+// MatchesDigest reports whether the manifest's payload describes the given
+// digest and hash, so that a new signature over a different file isn't
+// accidentally appended to an unrelated manifest found at the same path.
+func (m *SignatureManifest) MatchesDigest(digest []byte, hash crypto.Hash) (bool, error) {
+	payloadJSON, err := base64.RawURLEncoding.DecodeString(m.Payload)
+	if err != nil {
+		return false, fmt.Errorf("signers: decoding envelope payload: %w", err)
+	}
+	var payload envelopePayload
+	if err := json.Unmarshal(payloadJSON, &payload); err != nil {
+		return false, fmt.Errorf("signers: parsing envelope payload: %w", err)
+	}
+	wantDigest, err := base64.RawURLEncoding.DecodeString(payload.Digest)
+	if err != nil {
+		return false, fmt.Errorf("signers: decoding envelope digest: %w", err)
+	}
+	return payload.Hash == hash.String() && bytes.Equal(wantDigest, digest), nil
+}
+
+// AddSignature signs the manifest's payload with signer and appends the
+// result, along with certs (leaf first) and an optional RFC 3161 timestamp
+// token over the signature bytes, as a new parallel signature.
+func (m *SignatureManifest) AddSignature(signer crypto.Signer, certs []*x509.Certificate, hash crypto.Hash, timestamp []byte) error {
+	header := envelopeHeader{Alg: envelopeAlg(hash, signer.Public())}
+	if len(timestamp) != 0 {
+		header.Timestamp = base64.RawURLEncoding.EncodeToString(timestamp)
+	}
+	for _, cert := range certs {
+		header.Certificates = append(header.Certificates, base64.RawURLEncoding.EncodeToString(cert.Raw))
+	}
+	if len(certs) != 0 {
+		header.Identity = certs[0].Subject.CommonName
+	}
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return fmt.Errorf("signers: marshaling envelope header: %w", err)
+	}
+	protected := base64.RawURLEncoding.EncodeToString(headerJSON)
+	signingInput := protected + "." + m.Payload
+
+	var sigBytes []byte
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		sigBytes, err = signer.Sign(rand.Reader, []byte(signingInput), crypto.Hash(0))
+	} else {
+		h := hash.New()
+		h.Write([]byte(signingInput))
+		sigBytes, err = signer.Sign(rand.Reader, h.Sum(nil), hash)
+	}
+	if err != nil {
+		return fmt.Errorf("signers: signing envelope: %w", err)
+	}
+
+	m.Signatures = append(m.Signatures, EnvelopeSignature{
+		Protected: protected,
+		Signature: base64.RawURLEncoding.EncodeToString(sigBytes),
+	})
+	return nil
+}
+
+// envelopeAlg returns the JWS-style algorithm name for the given digest and
+// public key, following RFC 7518.
+func envelopeAlg(hash crypto.Hash, pub crypto.PublicKey) string {
+	switch pub.(type) {
+	case *ecdsa.PublicKey:
+		switch hash {
+		case crypto.SHA384:
+			return "ES384"
+		case crypto.SHA512:
+			return "ES512"
+		default:
+			return "ES256"
+		}
+	case ed25519.PublicKey:
+		return "EdDSA"
+	default:
+		switch hash {
+		case crypto.SHA384:
+			return "RS384"
+		case crypto.SHA512:
+			return "RS512"
+		default:
+			return "RS256"
+		}
+	}
+}
+
+// Write serializes the manifest as JSON.
+func (m *SignatureManifest) Write(w io.Writer) error {
+	return json.NewEncoder(w).Encode(m)
+}
+
+// ReadSignatureManifest deserializes a manifest previously written by
+// SignatureManifest.Write.
+func ReadSignatureManifest(r io.Reader) (*SignatureManifest, error) {
+	var m SignatureManifest
+	if err := json.NewDecoder(r).Decode(&m); err != nil {
+		return nil, fmt.Errorf("signers: decoding signature manifest: %w", err)
+	}
+	return &m, nil
+}
+
+// EnvelopeResult describes one verified signature from a SignatureManifest.
+type EnvelopeResult struct {
+	Identity     string
+	Certificate  *x509.Certificate
+	Chain        []*x509.Certificate
+	HasTimestamp bool
+}
+
+// VerifyEnvelope reconstructs the authenticode digest of the PowerShell
+// script read from r, cross-checks it against the manifest's payload, then
+// validates every signature in the manifest against that payload. It does
+// not by itself check the signer certificates against a trust store;
+// callers that need that should verify EnvelopeResult.Chain separately,
+// e.g. with (*x509.Certificate).Verify.
+func VerifyEnvelope(m *SignatureManifest, r io.Reader, style authenticode.PsSigStyle) ([]*EnvelopeResult, error) {
+	payloadJSON, err := base64.RawURLEncoding.DecodeString(m.Payload)
+	if err != nil {
+		return nil, fmt.Errorf("signers: decoding envelope payload: %w", err)
+	}
+	var payload envelopePayload
+	if err := json.Unmarshal(payloadJSON, &payload); err != nil {
+		return nil, fmt.Errorf("signers: parsing envelope payload: %w", err)
+	}
+	hash, err := hashNamed(payload.Hash)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := authenticode.DigestPowershell(r, style, hash)
+	if err != nil {
+		return nil, err
+	}
+	wantDigest, err := base64.RawURLEncoding.DecodeString(payload.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("signers: decoding envelope digest: %w", err)
+	}
+	if !bytes.Equal(digest.Sum(nil), wantDigest) {
+		return nil, errors.New("signers: script digest does not match envelope payload")
+	}
+
+	if len(m.Signatures) == 0 {
+		return nil, errors.New("signers: envelope has no signatures")
+	}
+	var results []*EnvelopeResult
+	for i, es := range m.Signatures {
+		result, err := verifyEnvelopeSignature(m.Payload, es)
+		if err != nil {
+			return nil, fmt.Errorf("signers: signature %d: %w", i, err)
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+func verifyEnvelopeSignature(payload string, es EnvelopeSignature) (*EnvelopeResult, error) {
+	headerJSON, err := base64.RawURLEncoding.DecodeString(es.Protected)
+	if err != nil {
+		return nil, fmt.Errorf("decoding header: %w", err)
+	}
+	var header envelopeHeader
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, fmt.Errorf("parsing header: %w", err)
+	}
+	if len(header.Certificates) == 0 {
+		return nil, errors.New("no certificates in header")
+	}
+	chain := make([]*x509.Certificate, len(header.Certificates))
+	for i, encoded := range header.Certificates {
+		der, err := base64.RawURLEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("decoding certificate %d: %w", i, err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("parsing certificate %d: %w", i, err)
+		}
+		chain[i] = cert
+	}
+	sigBytes, err := base64.RawURLEncoding.DecodeString(es.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("decoding signature: %w", err)
+	}
+	signingInput := es.Protected + "." + payload
+	leaf := chain[0]
+	if err := verifyRawSignature(leaf.PublicKey, header.Alg, []byte(signingInput), sigBytes); err != nil {
+		return nil, fmt.Errorf("signature verification failed: %w", err)
+	}
+
+	result := &EnvelopeResult{Identity: header.Identity, Certificate: leaf, Chain: chain}
+	if header.Timestamp != "" {
+		if err := verifyEnvelopeTimestamp(header.Timestamp, sigBytes); err != nil {
+			return nil, fmt.Errorf("verifying timestamp: %w", err)
+		}
+		result.HasTimestamp = true
+	}
+	return result, nil
+}
+
+// verifyEnvelopeTimestamp checks that the RFC 3161 token embedded in
+// header.Timestamp covers sigBytes and carries a cryptographically valid
+// TSA signature, the same checks pkcs9.VerifyTimestamp applies to an
+// embedded PKCS#7 timestamp. Without this, any party could splice in an
+// unsigned ContentInfoSignedData with a matching message imprint and have
+// it reported back as a valid timestamp.
+func verifyEnvelopeTimestamp(encoded string, sigBytes []byte) error {
+	tokenDER, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("decoding timestamp token: %w", err)
+	}
+	var token pkcs7.ContentInfoSignedData
+	if _, err := asn1.Unmarshal(tokenDER, &token); err != nil {
+		return fmt.Errorf("parsing timestamp token: %w", err)
+	}
+	if len(token.Content.SignerInfos) != 1 {
+		return errors.New("timestamp token should have exactly one SignerInfo")
+	}
+	tsi := token.Content.SignerInfos[0]
+	if !pkcs9.IsSupportedTimestampSignatureAlgorithm(tsi.DigestEncryptionAlgorithm.Algorithm) {
+		return fmt.Errorf("timestamp signed with unsupported algorithm %s", tsi.DigestEncryptionAlgorithm.Algorithm)
+	}
+	tsicerts, err := token.Content.Certificates.Parse()
+	if err != nil {
+		return fmt.Errorf("parsing timestamp certificates: %w", err)
+	}
+	info, err := pkcs9.UnpackTokenInfo(&token)
+	if err != nil {
+		return fmt.Errorf("unpacking timestamp token: %w", err)
+	}
+	imprintHash, err := x509tools.PkixDigestToHash(info.MessageImprint.HashAlgorithm)
+	if err != nil {
+		return fmt.Errorf("timestamp uses unknown digest: %w", err)
+	}
+	h := imprintHash.New()
+	h.Write(sigBytes)
+	if !bytes.Equal(h.Sum(nil), info.MessageImprint.HashedMessage) {
+		return errors.New("timestamp does not cover this signature")
+	}
+	verifyBlob, err := token.Content.ContentInfo.Bytes()
+	if err != nil {
+		return fmt.Errorf("reading timestamp content: %w", err)
+	}
+	// Verify the TSA's own signature over the TSTInfo blob; without this,
+	// the message imprint check above would accept a fabricated,
+	// unsigned token as long as the hash happened to match.
+	if _, err := tsi.Verify(verifyBlob, false, tsicerts); err != nil {
+		return fmt.Errorf("verifying timestamp signature: %w", err)
+	}
+	return nil
+}
+
+func verifyRawSignature(pub crypto.PublicKey, alg string, signingInput, sig []byte) error {
+	switch key := pub.(type) {
+	case *rsa.PublicKey:
+		hash, err := hashForAlg(alg)
+		if err != nil {
+			return err
+		}
+		h := hash.New()
+		h.Write(signingInput)
+		return rsa.VerifyPKCS1v15(key, hash, h.Sum(nil), sig)
+	case *ecdsa.PublicKey:
+		hash, err := hashForAlg(alg)
+		if err != nil {
+			return err
+		}
+		h := hash.New()
+		h.Write(signingInput)
+		if !ecdsa.VerifyASN1(key, h.Sum(nil), sig) {
+			return errors.New("ECDSA signature mismatch")
+		}
+		return nil
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, signingInput, sig) {
+			return errors.New("Ed25519 signature mismatch")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported public key type %T", pub)
+	}
+}
+
+func hashForAlg(alg string) (crypto.Hash, error) {
+	switch alg {
+	case "RS256", "ES256":
+		return crypto.SHA256, nil
+	case "RS384", "ES384":
+		return crypto.SHA384, nil
+	case "RS512", "ES512":
+		return crypto.SHA512, nil
+	default:
+		return 0, fmt.Errorf("unsupported algorithm %q", alg)
+	}
+}
+
+func hashNamed(name string) (crypto.Hash, error) {
+	for _, h := range []crypto.Hash{crypto.SHA256, crypto.SHA384, crypto.SHA512, crypto.SHA1} {
+		if h.String() == name {
+			return h, nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported hash %q", name)
+}
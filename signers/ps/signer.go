@@ -17,13 +17,19 @@
 package ps
 
 import (
+	"context"
+	"crypto"
+	"encoding/asn1"
 	"errors"
+	"fmt"
 	"io"
 	"os"
 	"strings"
 
 	"gerrit-pdt.unx.sas.com/tools/relic.git/lib/authenticode"
 	"gerrit-pdt.unx.sas.com/tools/relic.git/lib/certloader"
+	"gerrit-pdt.unx.sas.com/tools/relic.git/lib/pkcs7"
+	"gerrit-pdt.unx.sas.com/tools/relic.git/lib/pkcs9"
 	"gerrit-pdt.unx.sas.com/tools/relic.git/lib/x509tools"
 	"gerrit-pdt.unx.sas.com/tools/relic.git/signers"
 	"gerrit-pdt.unx.sas.com/tools/relic.git/signers/pkcs"
@@ -39,6 +45,9 @@ var PsSigner = &signers.Signer{
 
 func init() {
 	PsSigner.Flags().String("ps-style", "", "(Powershell) signature type")
+	PsSigner.Flags().String("bundle", "", "(optional) path to write a signature bundle, for out-of-band storage and re-verification")
+	PsSigner.Flags().String("manifest", "", "(optional) path to write a JWS-style signature manifest, for CI/CD systems that don't parse PKCS#7")
+	PsSigner.Flags().String("timestamp-url", "", "(optional) comma-separated RFC 3161 TSA URL(s) to timestamp with, in place of the signer's default")
 	signers.Register(PsSigner)
 }
 
@@ -56,6 +65,12 @@ func sign(r io.Reader, cert *certloader.Certificate, opts signers.SignOpts) ([]b
 	if err != nil {
 		return nil, err
 	}
+	// EC and Ed25519 signing keys require a specific digest to pair with
+	// the signature algorithm; override whatever hash was configured
+	// rather than letting the TSA request and SignerInfo disagree.
+	if required, ok := pkcs9.HashForKey(cert.Leaf.PublicKey); ok {
+		opts.Hash = required
+	}
 	digest, err := authenticode.DigestPowershell(r, style, opts.Hash)
 	if err != nil {
 		return nil, err
@@ -64,10 +79,31 @@ func sign(r io.Reader, cert *certloader.Certificate, opts signers.SignOpts) ([]b
 	if err != nil {
 		return nil, err
 	}
-	blob, err := pkcs.Timestamp(psd, cert, opts, true)
+	// If the caller configured its own TSA list, fetch the timestamp
+	// ourselves with the full pkcs9.TimestampClient (multiple URLs,
+	// retries, the legacy tcp:// transport) instead of going through
+	// pkcs.Timestamp's default path.
+	needStamp := true
+	if urlArg, _ := opts.Flags.GetString("timestamp-url"); urlArg != "" {
+		if err := timestampWithClient(psd, opts.Hash, urlArg); err != nil {
+			return nil, fmt.Errorf("requesting timestamp: %w", err)
+		}
+		needStamp = false
+	}
+	blob, err := pkcs.Timestamp(psd, cert, opts, needStamp)
 	if err != nil {
 		return nil, err
 	}
+	if bundlePath, _ := opts.Flags.GetString("bundle"); bundlePath != "" {
+		if err := writeBundle(bundlePath, blob, digest.Sum(nil), opts.Hash); err != nil {
+			return nil, err
+		}
+	}
+	if manifestPath, _ := opts.Flags.GetString("manifest"); manifestPath != "" {
+		if err := writeManifest(manifestPath, cert, blob, digest.Sum(nil), opts.Hash); err != nil {
+			return nil, err
+		}
+	}
 	patch, err := digest.MakePatch(blob)
 	if err != nil {
 		return nil, err
@@ -75,6 +111,110 @@ func sign(r io.Reader, cert *certloader.Certificate, opts signers.SignOpts) ([]b
 	return opts.SetBinPatch(patch)
 }
 
+// timestampWithClient requests a timestamp from the comma-separated TSA
+// URLs in rawURLs using a pkcs9.TimestampClient, over the hash of psd's lone
+// SignerInfo's EncryptedDigest (the imprint pkcs9.VerifyTimestamp checks),
+// and attaches the resulting token to that SignerInfo directly, so that
+// pkcs.Timestamp can be told to skip its own default timestamping step.
+func timestampWithClient(psd *pkcs7.ContentInfoSignedData, hash crypto.Hash, rawURLs string) error {
+	if len(psd.Content.SignerInfos) != 1 {
+		return errors.New("expected exactly one SignerInfo to timestamp")
+	}
+	client := &pkcs9.TimestampClient{
+		URLs: strings.Split(rawURLs, ","),
+		Hash: hash,
+	}
+	h := hash.New()
+	h.Write(psd.Content.SignerInfos[0].EncryptedDigest)
+	token, err := client.Timestamp(context.Background(), h.Sum(nil))
+	if err != nil {
+		return err
+	}
+	return pkcs9.AddStampToSignedAuthenticode(&psd.Content.SignerInfos[0], *token)
+}
+
+func writeBundle(path string, blob, fileDigest []byte, hash crypto.Hash) error {
+	bundle, err := signers.NewBundleFromSignedData(blob, fileDigest, hash.String())
+	if err != nil {
+		return fmt.Errorf("building signature bundle: %w", err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return bundle.Write(f)
+}
+
+// writeManifest writes a signature manifest to path. If a manifest already
+// exists there, the new signature is appended to it instead of replacing
+// it, so e.g. a release-engineering countersignature can be layered onto a
+// developer's existing manifest for the same script. blob is the completed,
+// possibly-timestamped signed data returned by pkcs.Timestamp; if it carries
+// a timestamp token, that token is attached to the manifest signature too.
+func writeManifest(path string, cert *certloader.Certificate, blob, fileDigest []byte, hash crypto.Hash) error {
+	manifest, err := loadOrCreateManifest(path, fileDigest, hash)
+	if err != nil {
+		return err
+	}
+	timestamp, err := manifestTimestampToken(blob)
+	if err != nil {
+		return fmt.Errorf("reading timestamp for manifest: %w", err)
+	}
+	if err := manifest.AddSignature(cert.Signer(), cert.Chain(), hash, timestamp); err != nil {
+		return fmt.Errorf("signing manifest: %w", err)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return manifest.Write(f)
+}
+
+// manifestTimestampToken extracts the DER-encoded RFC 3161 timestamp token
+// from blob's lone SignerInfo, the same way ExtractTimestampToken does for a
+// signature bundle. It returns nil, nil if blob was never timestamped.
+func manifestTimestampToken(blob []byte) ([]byte, error) {
+	var sd pkcs7.ContentInfoSignedData
+	if _, err := asn1.Unmarshal(blob, &sd); err != nil {
+		return nil, fmt.Errorf("parsing signed data: %w", err)
+	}
+	if len(sd.Content.SignerInfos) != 1 {
+		return nil, errors.New("expected exactly one SignerInfo")
+	}
+	token, err := signers.ExtractTimestampToken(&sd.Content.SignerInfos[0])
+	if _, ok := err.(pkcs7.ErrNoAttribute); ok {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func loadOrCreateManifest(path string, fileDigest []byte, hash crypto.Hash) (*signers.SignatureManifest, error) {
+	if f, err := os.Open(path); err == nil {
+		defer f.Close()
+		manifest, err := signers.ReadSignatureManifest(f)
+		if err != nil {
+			return nil, err
+		}
+		if ok, err := manifest.MatchesDigest(fileDigest, hash); err != nil {
+			return nil, fmt.Errorf("checking existing manifest: %w", err)
+		} else if !ok {
+			return nil, fmt.Errorf("existing manifest at %s describes a different file; refusing to append", path)
+		}
+		return manifest, nil
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("reading existing manifest: %w", err)
+	}
+	manifest, err := signers.NewSignatureManifest(fileDigest, hash)
+	if err != nil {
+		return nil, fmt.Errorf("building signature manifest: %w", err)
+	}
+	return manifest, nil
+}
+
 func verify(f *os.File, opts signers.VerifyOpts) ([]*signers.Signature, error) {
 	style, err := getStyle(f.Name())
 	if err != nil {
@@ -85,10 +225,39 @@ func verify(f *os.File, opts signers.VerifyOpts) ([]*signers.Signature, error) {
 		return nil, err
 	}
 	hash, _ := x509tools.PkixDigestToHash(ts.SignerInfo.DigestAlgorithm)
-	return []*signers.Signature{&signers.Signature{
+	sigs := []*signers.Signature{{
 		Hash:          hash,
 		X509Signature: ts,
-	}}, nil
+	}}
+	if bundlePath, _ := opts.Flags.GetString("bundle"); bundlePath != "" {
+		sig, err := verifyBundle(bundlePath, opts)
+		if err != nil {
+			return nil, fmt.Errorf("verifying bundle at %s: %w", bundlePath, err)
+		}
+		sigs = append(sigs, sig)
+	}
+	return sigs, nil
+}
+
+// verifyBundle re-verifies the out-of-band signature bundle written by
+// --bundle at sign time, independently of the artifact's own embedded
+// signature, and returns it as an additional parallel Signature.
+func verifyBundle(path string, opts signers.VerifyOpts) (*signers.Signature, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	bundle, err := signers.ReadBundle(f)
+	if err != nil {
+		return nil, err
+	}
+	tsig, err := bundle.Verify(opts.Roots, opts.Usage, opts.Revocation)
+	if err != nil {
+		return nil, err
+	}
+	hash, _ := x509tools.PkixDigestToHash(tsig.SignerInfo.DigestAlgorithm)
+	return &signers.Signature{Hash: hash, X509Signature: &tsig.Signature}, nil
 }
 
 func getStyle(name string) (authenticode.PsSigStyle, error) {